@@ -3,21 +3,149 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const numConnections = 100
 const numLinesPerUnit = 1000
 
-// note: -c flag uses ts-chan
-var command = []string{"/usr/bin/time", "-l", "node", "index.js", "-c"}
+var baseCommand = []string{"/usr/bin/time", "-l", "node", "index.js"}
+
+// bufferSize and channelMode are forwarded to the Node server so it sizes and behaves its
+// channel accordingly; workerRate throttles each drop-mode worker's write rate; useNativeQueue
+// switches every benchmark below from ts-chan to the server's native-Promise baseline queue, so
+// the two can be compared run-for-run.
+var bufferSize = flag.Int("buffer", 0, "channel buffer size to pass through to the server (0 uses the server's default)")
+var channelMode = flag.String("mode", "block", "channel backpressure mode to pass through to the server: block, drop, or latest")
+var workerRate = flag.Int("rate", 1000, "lines/sec each drop-mode worker is token-bucket throttled to")
+var useNativeQueue = flag.Bool("native", false, "benchmark the server's native-Promise baseline queue instead of ts-chan (omits -c)")
+
+// command is baseCommand with -c appended, unless -native is set, in which case the server falls
+// back to its native-Promise baseline queue. It's a function rather than a package var because it
+// depends on useNativeQueue, which isn't parsed from flags until after package vars are
+// initialized.
+func command() []string {
+	cmd := append([]string(nil), baseCommand...)
+	if !*useNativeQueue {
+		cmd = append(cmd, "-c")
+	}
+	return cmd
+}
+
+// echoCommand puts the server into echo mode, writing each received line back to its connection.
+func echoCommand() []string {
+	return append(command(), "-e")
+}
+
+func dropModeCommand() []string {
+	return append(command(), "-buffer", strconv.Itoa(*bufferSize), "-mode", *channelMode)
+}
+
+// wsCommand flips the server's fed pipeline onto a WebSocket upstream via -t ws, with echo mode
+// on so wsWorker's ackCount actually measures something (without -e the server never writes
+// anything back, so frames/sec would read zero).
+func wsCommand() []string {
+	return append(command(), "-t", "ws", "-e")
+}
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 54 * time.Second
+)
+
+// monitorOutPath, if set, receives a JSON summary of the monitor's samples once the benchmark
+// completes, so separate runs (e.g. ts-chan vs the native channel baseline) can be diffed by CI.
+var monitorOutPath = flag.String("monitor-out", os.Getenv("BENCHMARK_MONITOR_PATH"), "path to write a JSON monitor summary to (also configurable via BENCHMARK_MONITOR_PATH)")
+
+type monitorSummary struct {
+	TotalLines  uint64  `json:"total_lines"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+	LinesPerSec float64 `json:"lines_per_sec"`
+	NsPerLine   float64 `json:"ns_per_line"`
+}
+
+// monitor samples lineCount once per second until done fires, printing a running lines/sec,
+// cumulative total, elapsed time, and ns/line. Once done fires it writes a final summary to
+// monitorOutPath (if set) and closes the returned channel, so callers can wait for that flush
+// before tearing down.
+func monitor(lineCount *uint64, done chan bool) chan bool {
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+
+		start := time.Now()
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		var last uint64
+		for {
+			select {
+			case <-done:
+				writeMonitorSummary(atomic.LoadUint64(lineCount), time.Since(start))
+				return
+			case now := <-ticker.C:
+				total := atomic.LoadUint64(lineCount)
+				elapsed := now.Sub(start)
+				fmt.Printf("monitor: lines/sec=%.0f total=%d elapsed=%s ns/line=%.1f\n",
+					float64(total-last), total, elapsed, nsPerLine(elapsed, total))
+				last = total
+			}
+		}
+	}()
+	return stopped
+}
+
+// nsPerLine is float64(elapsed)/float64(total), guarded against the total == 0 case (no lines
+// written yet, or an empty benchmark run) where that division would otherwise yield +Inf, which
+// json.Encoder rejects outright.
+func nsPerLine(elapsed time.Duration, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(total)
+}
+
+func writeMonitorSummary(total uint64, elapsed time.Duration) {
+	if *monitorOutPath == "" {
+		return
+	}
+
+	summary := monitorSummary{
+		TotalLines:  total,
+		Elapsed:     elapsed.Seconds(),
+		LinesPerSec: float64(total) / elapsed.Seconds(),
+		NsPerLine:   nsPerLine(elapsed, total),
+	}
+
+	f, err := os.Create(*monitorOutPath)
+	if err != nil {
+		log.Printf("Failed to create monitor summary file %q: %v", *monitorOutPath, err)
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(summary); err != nil {
+		log.Printf("Failed to write monitor summary to %q: %v", *monitorOutPath, err)
+	}
+}
 
 func findOpenPort() (int, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -34,7 +162,14 @@ func findOpenPort() (int, error) {
 }
 
 func runServer(ctx context.Context, port int, logFilePath string) (*exec.Cmd, error) {
-	cmd := exec.CommandContext(ctx, command[0], append(append([]string(nil), command[1:]...), "-l", fmt.Sprintf("127.0.0.1:%d", port), "-o", logFilePath)...)
+	return runServerCmd(ctx, command(), port, logFilePath)
+}
+
+// runServerCmd starts the server with exec.Command rather than exec.CommandContext: the server
+// process's lifecycle is owned entirely by awaitShutdown's SIGTERM/SIGKILL escalation, so that
+// escalation isn't preempted by ctx (which also governs worker cancellation) being canceled first.
+func runServerCmd(ctx context.Context, command []string, port int, logFilePath string) (*exec.Cmd, error) {
+	cmd := exec.Command(command[0], append(append([]string(nil), command[1:]...), "-l", fmt.Sprintf("127.0.0.1:%d", port), "-o", logFilePath)...)
 	cmd.Stdout = nil
 	cmd.Stderr = os.Stderr
 	if err := cmd.Start(); err != nil {
@@ -43,7 +178,58 @@ func runServer(ctx context.Context, port int, logFilePath string) (*exec.Cmd, er
 	return cmd, nil
 }
 
-func worker(ctx context.Context, wg *sync.WaitGroup, start <-chan struct{}, address string, linesToWrite int, workerID int) {
+// shutdownTimeout bounds how long awaitShutdown waits for in-flight workers once a shutdown
+// signal fires, and how long it gives the server process to exit after SIGTERM before it is sent
+// SIGKILL; the wait after SIGKILL has no bound.
+const shutdownTimeout = 5 * time.Second
+
+// awaitShutdown watches for SIGINT/SIGTERM/SIGQUIT alongside normal worker completion (wgDone),
+// whichever comes first. On a signal it cancels ctx and waits (bounded) for the workers to stop;
+// either way it then escalates the server process from SIGTERM to SIGKILL until it exits, only
+// canceling ctx itself (a no-op by then for the workers, and irrelevant to the already-exited
+// server process) as the final step. A clean finish and a signal-driven one funnel through this
+// same path, so a partial run still yields data: progress, if non-nil, is logged so an
+// interrupted run reports how far it got.
+func awaitShutdown(cancel context.CancelFunc, serverCmd *exec.Cmd, srvDone <-chan struct{}, wgDone <-chan struct{}, progress *uint64) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sig)
+
+	select {
+	case <-wgDone:
+	case s := <-sig:
+		log.Printf("Received %s, shutting down early", s)
+		if progress != nil {
+			log.Printf("Lines written so far: %d", atomic.LoadUint64(progress))
+		}
+		cancel()
+		select {
+		case <-wgDone:
+		case <-time.After(shutdownTimeout):
+			log.Printf("Timed out waiting for workers to stop")
+		}
+	}
+
+	if serverCmd.Process != nil {
+		_ = serverCmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	killTimer := time.NewTimer(shutdownTimeout)
+	defer killTimer.Stop()
+
+	select {
+	case <-killTimer.C:
+		if serverCmd.Process != nil {
+			_ = serverCmd.Process.Kill()
+		}
+		<-srvDone
+	case <-srvDone:
+	}
+
+	cancel()
+}
+
+func worker(ctx context.Context, wg *sync.WaitGroup, start <-chan struct{}, address string, linesToWrite int, workerID int, lineCount *uint64) {
 	defer wg.Done()
 
 	select {
@@ -73,6 +259,7 @@ WriteLoop:
 			if err != nil {
 				log.Fatalf("Worker %d: Failed to write to server: %v", workerID, err)
 			}
+			atomic.AddUint64(lineCount, 1)
 		}
 	}
 
@@ -108,11 +295,12 @@ func BenchmarkServer(b *testing.B) {
 	time.Sleep(1 * time.Second)
 
 	start := make(chan struct{})
+	var lineCount uint64
 	var wg sync.WaitGroup
 	wg.Add(1)
 	for c := 0; c < numConnections; c++ {
 		wg.Add(1)
-		go worker(ctx, &wg, start, fmt.Sprintf("127.0.0.1:%d", port), b.N, c)
+		go worker(ctx, &wg, start, fmt.Sprintf("127.0.0.1:%d", port), b.N, c, &lineCount)
 	}
 	wg.Done()
 
@@ -120,19 +308,432 @@ func BenchmarkServer(b *testing.B) {
 
 	b.ResetTimer()
 
+	monitorDone := make(chan bool)
+	monitorStopped := monitor(&lineCount, monitorDone)
+
 	close(start)
 
-	wg.Wait()
+	wgDone := make(chan struct{})
+	go func() {
+		defer close(wgDone)
+		wg.Wait()
+	}()
+
+	awaitShutdown(cancel, serverCmd, srvDone, wgDone, &lineCount)
+
+	close(monitorDone)
+	<-monitorStopped
 
-	timer := time.NewTimer(5 * time.Second)
-	defer timer.Stop()
+	b.StopTimer()
+}
+
+// echoWorker drives one connection as a proxy: a writer goroutine feeds generated lines into the
+// connection, a reader goroutine copies whatever comes back out into sink, and rtCount is bumped
+// once per line read back off the wire.
+func echoWorker(ctx context.Context, wg *sync.WaitGroup, start <-chan struct{}, address string, linesToWrite int, workerID int, rtCount *uint64) {
+	defer wg.Done()
 
 	select {
-	case <-timer.C:
-		cancel()
-		<-srvDone
-	case <-srvDone:
+	case <-ctx.Done():
+		return
+	case <-start:
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Fatalf("Worker %d: Failed to connect to server: %v", workerID, err)
+	}
+	defer conn.Close()
+
+	srcR, srcW := io.Pipe()
+	sinkR, sinkW := io.Pipe()
+
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+
+	go func() {
+		defer close(p1die)
+		defer srcR.Close()
+		_, _ = io.Copy(conn, srcR)
+	}()
+	go func() {
+		defer close(p2die)
+		defer sinkW.Close()
+		_, _ = io.Copy(sinkW, conn)
+	}()
+
+	go func() {
+		defer srcW.Close()
+		writer := bufio.NewWriter(srcW)
+	WriteLoop:
+		for i := 0; i < linesToWrite*numLinesPerUnit; i++ {
+			select {
+			case <-ctx.Done():
+				break WriteLoop
+			default:
+				if _, err := writer.WriteString(fmt.Sprintf("line %016d\n", i)); err != nil {
+					break WriteLoop
+				}
+				if err := writer.Flush(); err != nil {
+					break WriteLoop
+				}
+			}
+		}
+	}()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		scanner := bufio.NewScanner(sinkR)
+		for scanner.Scan() {
+			atomic.AddUint64(rtCount, 1)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-p1die:
+	case <-p2die:
+	}
+
+	_ = conn.Close()
+	<-readDone
+}
+
+// BenchmarkServerEcho measures round-trip throughput against a ts-chan-backed Node server that
+// echoes each line it receives, exercising the channel plumbing in both directions at once rather
+// than the one-way write path covered by BenchmarkServer.
+func BenchmarkServerEcho(b *testing.B) {
+	port, err := findOpenPort()
+	if err != nil {
+		b.Fatalf("Failed to find an open port: %v", err)
+	}
+
+	localLogFilePath := fmt.Sprintf("%s-%d.log", "benchmark-server-echo", port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverCmd, err := runServerCmd(ctx, echoCommand(), port, localLogFilePath)
+	if err != nil {
+		b.Fatalf("Failed to start server: %v", err)
+	}
+
+	srvDone := make(chan struct{})
+	go func() {
+		defer close(srvDone)
+		if err := serverCmd.Wait(); err != nil {
+			b.Errorf("Failed to wait for server: %v", err)
+		}
+	}()
+
+	// Wait for the server to be ready
+	time.Sleep(1 * time.Second)
+
+	start := make(chan struct{})
+	var rtCount uint64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	for c := 0; c < numConnections; c++ {
+		wg.Add(1)
+		go echoWorker(ctx, &wg, start, fmt.Sprintf("127.0.0.1:%d", port), b.N, c, &rtCount)
+	}
+	wg.Done()
+
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	benchStart := time.Now()
+
+	close(start)
+
+	wgDone := make(chan struct{})
+	go func() {
+		defer close(wgDone)
+		wg.Wait()
+	}()
+
+	awaitShutdown(cancel, serverCmd, srvDone, wgDone, &rtCount)
+
+	elapsed := time.Since(benchStart)
+
+	b.StopTimer()
+
+	echoes := atomic.LoadUint64(&rtCount)
+	b.ReportMetric(float64(echoes)/elapsed.Seconds(), "echoes/sec")
+	if echoes > 0 {
+		// elapsed/echoes is the aggregate mean across all numConnections connections in flight at
+		// once, not a per-connection round-trip time, so it's reported as such rather than ns/rtt.
+		b.ReportMetric(float64(elapsed)/float64(echoes), "ns/echo")
+	}
+}
+
+// rateInterval converts linesPerSec into a per-token tick interval, clamped to at least 1ns so
+// time.NewTicker never sees a non-positive duration (which it panics on) for a very high rate.
+func rateInterval(linesPerSec int) time.Duration {
+	interval := time.Second / time.Duration(linesPerSec)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	return interval
+}
+
+// rateWorker writes at a fixed, token-bucket throttled rate rather than as fast as possible, so
+// BenchmarkServerDropMode can stress the server's backpressure handling under controlled load.
+func rateWorker(ctx context.Context, wg *sync.WaitGroup, start <-chan struct{}, address string, linesToWrite int, workerID int, linesPerSec int) {
+	defer wg.Done()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-start:
 	}
 
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Fatalf("Worker %d: Failed to connect to server: %v", workerID, err)
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	tokens := time.NewTicker(rateInterval(linesPerSec))
+	defer tokens.Stop()
+
+WriteLoop:
+	for i := 0; i < linesToWrite*numLinesPerUnit; i++ {
+		select {
+		case <-ctx.Done():
+			break WriteLoop
+		case <-tokens.C:
+			_, err := writer.WriteString(fmt.Sprintf("line %016d\n", i))
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				log.Fatalf("Worker %d: Failed to write to server: %v", workerID, err)
+			}
+		}
+	}
+
+	if err := conn.Close(); err != nil {
+		log.Fatalf("Worker %d: Failed to close connection: %v", workerID, err)
+	}
+}
+
+// scrapeDropLog counts delivered vs dropped lines out of the server's log file. The server logs a
+// "DROPPED" entry whenever its receive-side select hits the default (dropwarn) case instead of
+// delivering into the channel, so that marker is what distinguishes the two.
+func scrapeDropLog(path string) (delivered, dropped uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "DROPPED") {
+			dropped++
+		} else {
+			delivered++
+		}
+	}
+	return delivered, dropped, scanner.Err()
+}
+
+// BenchmarkServerDropMode stresses the ts-chan-backed server under overload: workers write at a
+// fixed rate rather than flat-out, and -buffer/-mode are forwarded to the server so its channel
+// can be sized and told to block, drop-oldest, or drop-newest. The server's log file is scraped
+// afterward to compare delivered vs dropped lines.
+func BenchmarkServerDropMode(b *testing.B) {
+	if *workerRate <= 0 {
+		b.Fatalf("-rate must be positive, got %d", *workerRate)
+	}
+
+	port, err := findOpenPort()
+	if err != nil {
+		b.Fatalf("Failed to find an open port: %v", err)
+	}
+
+	localLogFilePath := fmt.Sprintf("%s-%d.log", "benchmark-server-dropmode", port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverCmd, err := runServerCmd(ctx, dropModeCommand(), port, localLogFilePath)
+	if err != nil {
+		b.Fatalf("Failed to start server: %v", err)
+	}
+
+	srvDone := make(chan struct{})
+	go func() {
+		defer close(srvDone)
+		if err := serverCmd.Wait(); err != nil {
+			b.Errorf("Failed to wait for server: %v", err)
+		}
+	}()
+
+	// Wait for the server to be ready
+	time.Sleep(1 * time.Second)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	for c := 0; c < numConnections; c++ {
+		wg.Add(1)
+		go rateWorker(ctx, &wg, start, fmt.Sprintf("127.0.0.1:%d", port), b.N, c, *workerRate)
+	}
+	wg.Done()
+
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	benchStart := time.Now()
+
+	close(start)
+
+	wgDone := make(chan struct{})
+	go func() {
+		defer close(wgDone)
+		wg.Wait()
+	}()
+
+	awaitShutdown(cancel, serverCmd, srvDone, wgDone, nil)
+
+	elapsed := time.Since(benchStart)
+
+	b.StopTimer()
+
+	delivered, dropped, err := scrapeDropLog(localLogFilePath)
+	if err != nil {
+		b.Fatalf("Failed to scrape drop log %q: %v", localLogFilePath, err)
+	}
+
+	b.ReportMetric(float64(delivered)/elapsed.Seconds(), "delivered/sec")
+	b.ReportMetric(float64(dropped)/elapsed.Seconds(), "dropped/sec")
+	if total := delivered + dropped; total > 0 {
+		b.ReportMetric(float64(dropped)/float64(total), "drop-ratio")
+	}
+}
+
+// wsWorker drives one WebSocket connection, sending one text message per "line" and keeping the
+// connection alive with periodic pings, counting each frame the server acks back.
+func wsWorker(ctx context.Context, wg *sync.WaitGroup, start <-chan struct{}, url string, linesToWrite int, workerID int, ackCount *uint64) {
+	defer wg.Done()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-start:
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		log.Fatalf("Worker %d: Failed to dial server: %v", workerID, err)
+	}
+	defer conn.Close()
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			atomic.AddUint64(ackCount, 1)
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	i := 0
+WriteLoop:
+	for i < linesToWrite*numLinesPerUnit {
+		select {
+		case <-ctx.Done():
+			break WriteLoop
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				break WriteLoop
+			}
+		default:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("line %016d", i))); err != nil {
+				log.Fatalf("Worker %d: Failed to write to server: %v", workerID, err)
+			}
+			i++
+		}
+	}
+
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	_ = conn.Close()
+	<-readDone
+}
+
+// BenchmarkServerWS measures throughput when the server's upstream is a discrete-message
+// WebSocket connection rather than a raw newline-framed byte stream, which is a much more common
+// Node use-case than the TCP transport the other benchmarks exercise.
+func BenchmarkServerWS(b *testing.B) {
+	port, err := findOpenPort()
+	if err != nil {
+		b.Fatalf("Failed to find an open port: %v", err)
+	}
+
+	localLogFilePath := fmt.Sprintf("%s-%d.log", "benchmark-server-ws", port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverCmd, err := runServerCmd(ctx, wsCommand(), port, localLogFilePath)
+	if err != nil {
+		b.Fatalf("Failed to start server: %v", err)
+	}
+
+	srvDone := make(chan struct{})
+	go func() {
+		defer close(srvDone)
+		if err := serverCmd.Wait(); err != nil {
+			b.Errorf("Failed to wait for server: %v", err)
+		}
+	}()
+
+	// Wait for the server to be ready
+	time.Sleep(1 * time.Second)
+
+	url := fmt.Sprintf("ws://127.0.0.1:%d", port)
+	start := make(chan struct{})
+	var ackCount uint64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	for c := 0; c < numConnections; c++ {
+		wg.Add(1)
+		go wsWorker(ctx, &wg, start, url, b.N, c, &ackCount)
+	}
+	wg.Done()
+
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	benchStart := time.Now()
+
+	close(start)
+
+	wgDone := make(chan struct{})
+	go func() {
+		defer close(wgDone)
+		wg.Wait()
+	}()
+
+	awaitShutdown(cancel, serverCmd, srvDone, wgDone, &ackCount)
+
+	elapsed := time.Since(benchStart)
+
 	b.StopTimer()
+
+	acked := atomic.LoadUint64(&ackCount)
+	b.ReportMetric(float64(acked)/elapsed.Seconds(), "frames/sec")
 }